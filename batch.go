@@ -0,0 +1,152 @@
+// MIT License
+
+// Copyright (c) 2024 Ryan Young
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Default number of messages fetched and imported per batch, used when an
+// account doesn't set imapCredentials.BatchSize.
+const defaultBatchSize = 32
+
+// Maximum number of concurrent Gmail imports per batch, to stay well within
+// the API's per-user quota.
+const importConcurrency = 8
+
+// Drain every message currently in the selected mailbox, in batches of up
+// to imapCreds.BatchSize messages: before each batch a UID SEARCH lists the
+// messages still in the mailbox, a pipelined UID FETCH retrieves the batch,
+// messages are imported to Gmail concurrently, and only the UIDs that
+// imported successfully are expunged.
+func drainMailbox(
+	client *imapclient.Client,
+	imapCreds *imapCredentials,
+	mail *gmail.Service,
+	labelIDs map[string]string,
+	flagLabelIDs map[string]string,
+) error {
+	batchSize := imapCreds.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	for {
+		uids, err := searchAllUIDs(client)
+		if err != nil {
+			return err
+		}
+		if len(uids) <= 0 {
+			return nil
+		}
+
+		if len(uids) > batchSize {
+			uids = uids[:batchSize]
+		}
+
+		msgs, err := fetchMessages(client, uids)
+		if err != nil {
+			return err
+		}
+
+		imported := importBatch(mail, imapCreds.Username, msgs, labelIDs, flagLabelIDs)
+		if len(imported) > 0 {
+			if err := deleteMessages(client, imported); err != nil {
+				return err
+			}
+		}
+
+		if len(imported) < len(msgs) {
+			return fmt.Errorf(
+				"imported %d/%d messages from %s; will retry the rest on the next connection",
+				len(imported), len(msgs), imapCreds.Username)
+		}
+	}
+}
+
+// List the UIDs of every message in the selected mailbox.
+func searchAllUIDs(client *imapclient.Client) ([]imap.UID, error) {
+	data, err := client.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		slog.Error("UID SEARCH error", "err", err)
+		return nil, err
+	}
+	return data.AllUIDs(), nil
+}
+
+// Import a batch of messages to Gmail concurrently, bounded by
+// importConcurrency. Returns the UIDs of the messages that imported
+// successfully; the caller is responsible for expunging them.
+func importBatch(
+	mail *gmail.Service,
+	account string,
+	msgs []*message,
+	labelIDs map[string]string,
+	flagLabelIDs map[string]string,
+) []imap.UID {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		imported []imap.UID
+		sem      = make(chan struct{}, importConcurrency)
+		ids      = labelIDValues(labelIDs)
+	)
+
+	for _, msg := range msgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(msg *message) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			slog.Info("importing message",
+				"account", account, "sizeKB", float32(len(msg.contents))/1024)
+
+			start := time.Now()
+			err := msg.importToGmail(mail, ids, flagLabelIDs)
+			importDurationSeconds.WithLabelValues(account).Observe(time.Since(start).Seconds())
+
+			if err != nil {
+				importErrorsTotal.WithLabelValues(account).Inc()
+				return
+			}
+
+			messagesImportedTotal.WithLabelValues(account).Inc()
+			lastSuccessTimestamp.WithLabelValues(account).SetToCurrentTime()
+
+			mu.Lock()
+			imported = append(imported, msg.uid)
+			mu.Unlock()
+		}(msg)
+	}
+	wg.Wait()
+
+	return imported
+}
@@ -0,0 +1,165 @@
+// MIT License
+
+// Copyright (c) 2024 Ryan Young
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-sasl"
+	"golang.org/x/oauth2"
+)
+
+// OAuth client credentials for a single IMAP account, used when its
+// AuthMethod is "xoauth2" or "oauthbearer".
+type imapOAuthCredentials struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	TokenURL     string
+}
+
+// Authenticate to the IMAP server using whichever method this account
+// configures, retrying an OAuth login once if the server rejects the
+// access token as expired.
+func authenticate(client *imapclient.Client, creds *imapCredentials, store *configStore) error {
+	switch creds.AuthMethod {
+	case "", "plain":
+		if err := client.Login(creds.Username, creds.Password).Wait(); err != nil {
+			slog.Error("LOGIN error", "account", creds.Username, "err", err)
+			return err
+		}
+		return nil
+
+	case "xoauth2", "oauthbearer":
+		return authenticateOAuth(client, creds, store)
+
+	default:
+		err := fmt.Errorf("unknown auth method %q", creds.AuthMethod)
+		slog.Error("AUTHENTICATE error", "account", creds.Username, "err", err)
+		return err
+	}
+}
+
+// Authenticate using XOAUTH2 or OAUTHBEARER, refreshing the access token
+// once and retrying if the server reports the first attempt as expired.
+func authenticateOAuth(client *imapclient.Client, creds *imapCredentials, store *configStore) error {
+	token, err := refreshAccessToken(creds, store)
+	if err != nil {
+		return err
+	}
+
+	err = client.Authenticate(oauthSASLClient(creds, token))
+	if err != nil && isAuthExpired(err) {
+		slog.Warn("AUTHENTICATE error, retrying with a fresh token", "account", creds.Username, "err", err)
+
+		token, err = refreshAccessToken(creds, store)
+		if err != nil {
+			return err
+		}
+		err = client.Authenticate(oauthSASLClient(creds, token))
+	}
+
+	if err != nil {
+		slog.Error("AUTHENTICATE error", "account", creds.Username, "err", err)
+		return err
+	}
+	return nil
+}
+
+// Whether an AUTHENTICATE failure looks like a rejected or expired access
+// token, as opposed to a permanent configuration problem.
+func isAuthExpired(err error) bool {
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) {
+		return false
+	}
+	return imapErr.Code == imap.ResponseCodeAuthenticationFailed || imapErr.Code == imap.ResponseCodeExpired
+}
+
+// Build the SASL client for the account's chosen OAuth mechanism.
+func oauthSASLClient(creds *imapCredentials, token string) sasl.Client {
+	if creds.AuthMethod == "oauthbearer" {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: creds.Username,
+			Token:    token,
+		})
+	}
+	return &xoauth2Client{username: creds.Username, token: token}
+}
+
+// Exchange this account's refresh token for a fresh access token, and
+// persist a rotated refresh token back to the config file if the provider
+// issued a new one.
+func refreshAccessToken(creds *imapCredentials, store *configStore) (string, error) {
+	if creds.OAuth == nil {
+		err := fmt.Errorf("account %s has no OAuth credentials configured", creds.Username)
+		slog.Error(err.Error())
+		return "", err
+	}
+
+	oauthCfg := &oauth2.Config{
+		ClientID:     creds.OAuth.ClientID,
+		ClientSecret: creds.OAuth.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: creds.OAuth.TokenURL},
+	}
+
+	tok, err := oauthCfg.TokenSource(
+		context.Background(),
+		&oauth2.Token{RefreshToken: creds.OAuth.RefreshToken},
+	).Token()
+	if err != nil {
+		slog.Error("unable to refresh access token", "account", creds.Username, "err", err)
+		return "", err
+	}
+
+	if tok.RefreshToken != "" && tok.RefreshToken != creds.OAuth.RefreshToken {
+		store.update(func(*config) { creds.OAuth.RefreshToken = tok.RefreshToken })
+	}
+
+	return tok.AccessToken, nil
+}
+
+// A minimal SASL client for the XOAUTH2 mechanism, as used by Gmail and
+// other providers. go-sasl doesn't ship one since XOAUTH2 was superseded by
+// the standardized OAUTHBEARER, but plenty of servers still only speak the
+// former.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", c.username, c.token))
+	return "XOAUTH2", ir, nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends an empty continuation to let the client abort after
+	// reporting an error; responding with an empty line completes that.
+	return []byte{}, nil
+}
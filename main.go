@@ -28,8 +28,9 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
@@ -43,33 +44,105 @@ import (
 
 const maxPollTime = 5 * time.Minute
 
+var (
+	reauth = flag.Bool(
+		"reauth", false,
+		"discard the stored Gmail token and run the OAuth flow again")
+	metricsAddr = flag.String(
+		"metrics-addr", "",
+		"address to serve Prometheus metrics and /healthz, /readyz on (disabled if empty)")
+)
+
+// Log the given message at error level and terminate the process, the
+// slog equivalent of log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
 	flag.Parse()
 
-	cfg := &config{}
+	store := &configStore{cfg: &config{}}
 
 	f, err := os.OpenFile(flag.Arg(0), os.O_RDWR, 0600)
 	if err != nil {
-		log.Fatalf("Failed to open config file: %v", err)
+		fatal("failed to open config file", "err", err)
+	}
+	store.f = f
+
+	if err := json.NewDecoder(f).Decode(store.cfg); err != nil {
+		fatal("failed to parse config file", "err", err)
 	}
 
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	if len(store.cfg.Imap) <= 0 {
+		fatal("failed to parse config file: IMAP credentials section is empty or not a JSON list")
 	}
 
-	if len(cfg.Imap) <= 0 {
-		log.Fatalf("Failed to parse config file: " +
-			"IMAP credentials section is empty or not a JSON list")
+	for _, imapCreds := range store.cfg.Imap {
+		for _, rule := range imapCreds.Rules {
+			if rule.Interval.Duration() <= 0 {
+				fatal("invalid rule config: interval must be positive",
+					"account", imapCreds.Username, "query", rule.Query)
+			}
+			if rule.Action != "trash" && rule.Action != "archive" {
+				fatal(`invalid rule config: action must be "trash" or "archive"`,
+					"account", imapCreds.Username, "query", rule.Query, "action", rule.Action)
+			}
+		}
 	}
 
-	mail := getGmailService(*cfg, f)
-	f.Close()
+	serveMetrics(*metricsAddr)
+
+	mail := getGmailService(store)
+
+	// Resolved once and shared across every account: all accounts mirror the
+	// same IMAP flags onto the same two custom labels, so resolving them per
+	// account would just race every goroutine's List/Create against each
+	// other on first run.
+	flagLabelIDs, err := ensureLabels(mail, []string{"IMAP/Answered", "IMAP/Forwarded"})
+	if err != nil {
+		fatal("unable to resolve Gmail flag labels", "err", err)
+	}
+
+	// Likewise resolve the union of every account's configured labels up
+	// front: two accounts naming the same label would otherwise race
+	// List/Create against each other just like the flag labels above.
+	labelNames := map[string]struct{}{}
+	for _, imapCreds := range store.cfg.Imap {
+		for _, name := range imapCreds.Labels {
+			labelNames[name] = struct{}{}
+		}
+	}
+	uniqueLabelNames := make([]string, 0, len(labelNames))
+	for name := range labelNames {
+		uniqueLabelNames = append(uniqueLabelNames, name)
+	}
+	allLabelIDs, err := ensureLabels(mail, uniqueLabelNames)
+	if err != nil {
+		fatal("unable to resolve Gmail labels", "err", err)
+	}
 
 	// Spin up a goroutine for each IMAP connection.
-	for _, imapCreds := range cfg.Imap {
+	for i := range store.cfg.Imap {
+		imapCreds := &store.cfg.Imap[i]
 		go func() {
+			labelIDs := make(map[string]string, len(imapCreds.Labels))
+			for _, name := range imapCreds.Labels {
+				labelIDs[name] = allLabelIDs[name]
+			}
+
+			for _, rule := range imapCreds.Rules {
+				go runRule(mail, imapCreds.Username, rule)
+			}
+
 			for {
-				doSession(&imapCreds, mail)
+				start := time.Now()
+				err := doSession(imapCreds, store, mail, labelIDs, flagLabelIDs)
+				sessionDurationSeconds.WithLabelValues(imapCreds.Username).Observe(time.Since(start).Seconds())
+				if err != nil {
+					imapReconnectsTotal.WithLabelValues(imapCreds.Username).Inc()
+				}
 
 				// Error'd out. Cool down and try again.
 				time.Sleep(maxPollTime)
@@ -78,7 +151,8 @@ func main() {
 	}
 
 	// Put the main goroutine to sleep.
-	log.Printf("Startup complete; waiting for mail")
+	ready.Store(true)
+	slog.Info("startup complete; waiting for mail")
 	select {}
 }
 
@@ -87,67 +161,144 @@ type config struct {
 	Imap    []imapCredentials
 	Secrets interface{}
 	Tokens  *oauth2.Token `json:",omitempty"`
+
+	// OAuth scopes Tokens was granted under. Compared against gmailScope on
+	// startup so that a token saved by an older version of this program,
+	// which requested fewer scopes, is discarded and re-consented instead
+	// of failing every Gmail API call with a 403.
+	Scope string `json:",omitempty"`
 }
 
 // Save this configuration back to a JSON file.
 func (c *config) writeTo(f *os.File) {
 	if _, err := f.Seek(0, 0); err != nil {
-		log.Fatalf("Unable to seek config file: %v", err)
+		fatal("unable to seek config file", "err", err)
 	}
 
 	if err := json.NewEncoder(f).Encode(c); err != nil {
-		log.Fatalf("Unable to write back to config file: %v", err)
+		fatal("unable to write back to config file", "err", err)
 	}
 }
 
+// Guards concurrent writes to the config file: the Gmail token notifier and
+// every IMAP account's OAuth token refresh can all rotate credentials and
+// need to persist them back independently.
+type configStore struct {
+	mu  sync.Mutex
+	cfg *config
+	f   *os.File
+}
+
+// Atomically mutate the configuration and persist the result, so that a
+// field write and the save that follows it can't interleave with another
+// goroutine's update or writeTo.
+func (s *configStore) update(f func(*config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.cfg)
+	s.cfg.writeTo(s.f)
+}
+
 // Information needed to connect to an IMAP server. Implicit TLS is mandatory.
 type imapCredentials struct {
 	Address  string
 	Username string
 	Password string
+
+	// Gmail labels to apply to every message imported from this account, in
+	// addition to INBOX and the labels mirrored from its IMAP flags. Labels
+	// that don't already exist are created.
+	Labels []string `json:",omitempty"`
+
+	// Scheduled Gmail searches that trash or archive matching messages, run
+	// independently of the IMAP import loop.
+	Rules []gmailRule `json:",omitempty"`
+
+	// Maximum number of messages fetched and imported per batch. Defaults to
+	// defaultBatchSize if unset.
+	BatchSize int `json:",omitempty"`
+
+	// How to authenticate to this account: "plain" (the default, plain
+	// LOGIN with Username/Password), "xoauth2", or "oauthbearer". The
+	// latter two require OAuth to be set.
+	AuthMethod string `json:",omitempty"`
+
+	// OAuth client credentials and refresh token used when AuthMethod is
+	// "xoauth2" or "oauthbearer", for providers like Gmail, Office 365, or
+	// Fastmail that don't support long-lived app passwords.
+	OAuth *imapOAuthCredentials `json:",omitempty"`
 }
 
+// Gmail scopes needed by this program: importing messages, listing and
+// creating labels for per-account label mapping and flag mirroring, and
+// searching and batch-modifying messages for pruning rules. Notably this
+// does not include https://mail.google.com/, so pruning rules must not rely
+// on Users.Messages.BatchDelete, which requires that full scope.
+const gmailScope = gmail.GmailModifyScope
+
 // Obtain access to the Gmail API, refreshing and saving access tokens if
 // needed.
-func getGmailService(cfg config, cfgFile *os.File) *gmail.Service {
+func getGmailService(store *configStore) *gmail.Service {
 	ctx := context.Background()
 
 	// Need to submit the client secret as JSON bytes, leading to this silly
 	// re-encode step.
-	secrets, err := json.Marshal(cfg.Secrets)
+	secrets, err := json.Marshal(store.cfg.Secrets)
 	if err != nil {
-		log.Fatalf("JSON re-encode error: %v", err)
+		fatal("JSON re-encode error", "err", err)
 	}
 
-	oauth, err := google.ConfigFromJSON(secrets, gmail.GmailInsertScope)
+	oauth, err := google.ConfigFromJSON(secrets, gmailScope)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret to oauth2 config: %v", err)
+		fatal("unable to parse client secret to oauth2 config", "err", err)
 	}
 
 	// Attempt to retrieve stored access and refresh tokens; otherwise request
-	// them from Google.
+	// them from Google via the OAuth loopback flow. A token saved under a
+	// different scope (e.g. by an older version of this program) can't be
+	// reused as-is, since Google won't silently upgrade its grant, so treat
+	// it the same as a missing token and force re-consent.
 	var tok *oauth2.Token
-	if cfg.Tokens != nil {
-		tok = cfg.Tokens
+	if store.cfg.Tokens != nil && store.cfg.Scope == gmailScope && !*reauth {
+		tok = store.cfg.Tokens
 	} else {
 		tok = getTokenFromWeb(oauth)
 
-		cfg.Tokens = tok
-		cfg.writeTo(cfgFile)
+		store.update(func(c *config) { c.Tokens = tok; c.Scope = gmailScope })
+	}
+
+	// Wrap the token source so that whenever it refreshes the access token
+	// (or is handed a new refresh token), the rotated token is written back
+	// to the config file. Without this, a refresh token rotated by Google
+	// would only ever live in memory and be lost on restart.
+	source := &savingTokenSource{
+		src: oauth2.ReuseTokenSource(tok, oauth.TokenSource(ctx, tok)),
+		save: func(t *oauth2.Token) {
+			store.update(func(c *config) { c.Tokens = t })
+		},
 	}
-	client := oauth.Client(ctx, tok)
+	client := oauth2.NewClient(ctx, source)
 
 	// Finally, create our Gmail client.
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		fatal("unable to retrieve Gmail client", "err", err)
 	}
 
 	return srv
 }
 
 // Make a new connection to the IMAP server and retrieve and expunge messages.
-func doSession(imap *imapCredentials, mail *gmail.Service) error {
+// labelIDs are the resolved Gmail label IDs to apply to every imported
+// message, from imapCredentials.Labels. flagLabelIDs resolves the custom
+// labels used to mirror IMAP flags that have no Gmail system label.
+func doSession(
+	imap *imapCredentials,
+	store *configStore,
+	mail *gmail.Service,
+	labelIDs map[string]string,
+	flagLabelIDs map[string]string,
+) error {
 	// Make a handler and channel to receive mailbox status updates.
 	var (
 		mailboxUpdate = make(chan *imapclient.UnilateralDataMailbox)
@@ -164,107 +315,138 @@ func doSession(imap *imapCredentials, mail *gmail.Service) error {
 	client, err := imapclient.DialTLS(
 		imap.Address, &imapclient.Options{UnilateralDataHandler: dataHandler})
 	if err != nil {
-		log.Printf("Error connecting to IMAP server: %v", err)
+		slog.Error("error connecting to IMAP server", "account", imap.Username, "err", err)
 		return err
 	}
 	defer client.Close()
 
 	// Provide credentials.
-	if err := client.
-		Login(imap.Username, imap.Password).
-		Wait(); err != nil {
-
-		log.Printf("LOGIN error: %v", err)
+	if err := authenticate(client, imap, store); err != nil {
 		return err
 	}
 
 	for {
-		// Interrogate the inbox and retrieve and expunge everything inside.
-		for {
-			inbox, err := client.
-				Select("INBOX", nil).
-				Wait()
-			if err != nil {
-				log.Printf("SELECT error: %v", err)
-				return err
-			}
-
-			if inbox.NumMessages <= 0 {
-				break
-			}
-
-			msg, err := fetchFirstMessage(client)
-			if err != nil {
-				return err
-			}
-			if msg == nil {
-				break
-			}
-
-			log.Printf(
-				"Importing message received by %s (size %.1fK)",
-				imap.Username, float32(len(msg.contents))/1024)
-
-			if err := msg.importToGmail(mail); err != nil {
-				return err
-			}
+		// Select the inbox and drain it in batches.
+		if _, err := client.Select("INBOX", nil).Wait(); err != nil {
+			slog.Error("SELECT error", "account", imap.Username, "err", err)
+			return err
+		}
 
-			if err := deleteMessage(client, msg.uid); err != nil {
-				return err
-			}
+		if err := drainMailbox(client, imap, mail, labelIDs, flagLabelIDs); err != nil {
+			return err
 		}
 
 		// Go back to sleep until the next mailbox update.
-		if err := doIdle(client, mailboxUpdate, maxPollTime); err != nil {
+		if err := doIdle(client, imap.Username, mailboxUpdate, maxPollTime); err != nil {
 			return err
 		}
 	}
 }
 
-// Retrieve inbox message sequence number 1.
-func fetchFirstMessage(client *imapclient.Client) (*message, error) {
+// Fetch the given messages' bodies, flags, and internal dates in a single
+// pipelined UID FETCH.
+func fetchMessages(client *imapclient.Client, uids []imap.UID) ([]*message, error) {
 	var (
 		// Set an empty body section to request the raw contents of the entire
 		// message.
 		entireMessage = []*imap.FetchItemBodySection{{}}
 		fetch         = client.Fetch(
-			imap.SeqSetNum(1), &imap.FetchOptions{BodySection: entireMessage})
+			imap.UIDSetNum(uids...), &imap.FetchOptions{
+				BodySection:  entireMessage,
+				Flags:        true,
+				InternalDate: true})
 	)
 	defer fetch.Close()
 
-	messages, err := fetch.Collect()
+	buffers, err := fetch.Collect()
 	if err != nil {
-		log.Printf("FETCH error: %v", err)
+		slog.Error("FETCH error", "err", err)
 		return nil, err
 	}
 
-	if len(messages) <= 0 {
-		return nil, nil
-	}
-
-	var (
-		msg  = messages[0]
-		data []byte
-	)
-	for _, sectionData := range msg.BodySection {
-		data = append(data, sectionData...)
+	msgs := make([]*message, 0, len(buffers))
+	for _, msg := range buffers {
+		var data []byte
+		for _, sectionData := range msg.BodySection {
+			data = append(data, sectionData.Bytes...)
+		}
+		msgs = append(msgs, &message{
+			uid:          msg.UID,
+			contents:     data,
+			flags:        msg.Flags,
+			internalDate: msg.InternalDate})
 	}
-	return &message{
-		uid:      msg.UID,
-		contents: data}, nil
+	return msgs, nil
 }
 
 // An email fetched from an IMAP mailbox.
 type message struct {
-	uid      imap.UID
-	contents []byte
+	uid          imap.UID
+	contents     []byte
+	flags        []imap.Flag
+	internalDate time.Time
 }
 
-// Import this message to Gmail via media upload.
-func (m *message) importToGmail(mail *gmail.Service) error {
-	r, err := mail.Users.Messages.
-		Import("me", &gmail.Message{LabelIds: []string{"INBOX", "UNREAD"}}).
-		InternalDateSource("dateHeader").
+// Whether this message carries the given IMAP flag or keyword.
+func (m *message) hasFlag(flag imap.Flag) bool {
+	for _, f := range m.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of the Gmail system and custom labels that mirror this message's
+// IMAP flags: UNREAD is added unless \Seen is set, \Flagged maps to
+// STARRED, and \Answered/$Forwarded map to custom labels resolved by the
+// caller via flagLabelIDs.
+func (m *message) flagLabelNames() []string {
+	var names []string
+	if !m.hasFlag(imap.FlagSeen) {
+		names = append(names, "UNREAD")
+	}
+	if m.hasFlag(imap.FlagFlagged) {
+		names = append(names, "STARRED")
+	}
+	if m.hasFlag(imap.FlagAnswered) {
+		names = append(names, "IMAP/Answered")
+	}
+	if m.hasFlag(imap.FlagForwarded) {
+		names = append(names, "IMAP/Forwarded")
+	}
+	return names
+}
+
+// Import this message to Gmail via media upload. labelIDs are applied on
+// top of the labels derived from this message's IMAP flags; flagLabelIDs
+// resolves the custom IMAP/Answered and IMAP/Forwarded label names to
+// Gmail IDs, and "STARRED"/"UNREAD" are passed through as-is since they're
+// Gmail system label IDs.
+func (m *message) importToGmail(
+	mail *gmail.Service, labelIDs []string, flagLabelIDs map[string]string,
+) error {
+	gmailMsg := &gmail.Message{LabelIds: append([]string{"INBOX"}, labelIDs...)}
+	for _, name := range m.flagLabelNames() {
+		switch name {
+		case "UNREAD", "STARRED":
+			gmailMsg.LabelIds = append(gmailMsg.LabelIds, name)
+		default:
+			if id, ok := flagLabelIDs[name]; ok {
+				gmailMsg.LabelIds = append(gmailMsg.LabelIds, id)
+			}
+		}
+	}
+
+	call := mail.Users.Messages.Import("me", gmailMsg)
+	if !m.internalDate.IsZero() {
+		gmailMsg.InternalDate = m.internalDate.UnixMilli()
+		call = call.InternalDateSource("customTimestamp")
+	} else {
+		call = call.InternalDateSource("dateHeader")
+	}
+
+	r, err := call.
 		NeverMarkSpam(false).
 		ProcessForCalendar(true).
 		Deleted(false).
@@ -273,41 +455,42 @@ func (m *message) importToGmail(mail *gmail.Service) error {
 			googleapi.ContentType("message/rfc822")).
 		Do()
 	if err != nil {
-		log.Printf("Error uploading to Gmail: %v", err)
+		slog.Error("error uploading to Gmail", "err", err)
 		return err
 	}
 
 	if r.HTTPStatusCode != 200 {
 		err := fmt.Errorf("gmail returned status code: %v", r.HTTPStatusCode)
-		log.Printf("%v", err)
+		slog.Error(err.Error())
 		return err
 	}
 
 	return nil
 }
 
-// Expunge a message from the inbox by UID.
-func deleteMessage(client *imapclient.Client, uid imap.UID) error {
+// Expunge a batch of messages from the inbox by UID, in a single STORE and
+// EXPUNGE round-trip.
+func deleteMessages(client *imapclient.Client, uids []imap.UID) error {
 	var (
-		setNum     = imap.UIDSetNum(uid)
+		setNum     = imap.UIDSetNum(uids...)
 		addDeleted = &imap.StoreFlags{
 			Op:     imap.StoreFlagsAdd,
 			Silent: true,
 			Flags:  []imap.Flag{imap.FlagDeleted}}
 	)
-	if err := client.
+	if _, err := client.
 		Store(setNum, addDeleted, nil).
-		Wait(); err != nil {
+		Collect(); err != nil {
 
-		log.Printf("STORE error: %v", err)
+		slog.Error("STORE error", "err", err)
 		return err
 	}
 
-	if err := client.
+	if _, err := client.
 		Expunge().
-		Wait(); err != nil {
+		Collect(); err != nil {
 
-		log.Printf("EXPUNGE error: %v", err)
+		slog.Error("EXPUNGE error", "err", err)
 		return err
 	}
 
@@ -318,15 +501,19 @@ func deleteMessage(client *imapclient.Client, uid imap.UID) error {
 // elapsed.
 func doIdle(
 	client *imapclient.Client,
+	account string,
 	mailboxUpdate chan *imapclient.UnilateralDataMailbox,
 	deadline time.Duration,
 ) error {
 	idle, err := client.Idle()
 	if err != nil {
-		log.Printf("IDLE error: %v", err)
+		slog.Error("IDLE error", "account", account, "err", err)
 		return err
 	}
 
+	idleConnections.WithLabelValues(account).Set(1)
+	defer idleConnections.WithLabelValues(account).Set(0)
+
 	timer := time.NewTimer(deadline)
 	select {
 	case <-mailboxUpdate:
@@ -335,12 +522,12 @@ func doIdle(
 	}
 
 	if err := idle.Close(); err != nil {
-		log.Printf("IDLE error: %v", err)
+		slog.Error("IDLE error", "account", account, "err", err)
 		return err
 	}
 
 	if err := idle.Wait(); err != nil {
-		log.Printf("IDLE error: %v", err)
+		slog.Error("IDLE error", "account", account, "err", err)
 		return err
 	}
 
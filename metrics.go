@@ -0,0 +1,101 @@
+// MIT License
+
+// Copyright (c) 2024 Ryan Young
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesImportedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "turbogmailify_messages_imported_total",
+		Help: "Total number of messages successfully imported to Gmail.",
+	}, []string{"account"})
+
+	importErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "turbogmailify_import_errors_total",
+		Help: "Total number of messages that failed to import to Gmail.",
+	}, []string{"account"})
+
+	imapReconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "turbogmailify_imap_reconnects_total",
+		Help: "Total number of times an IMAP session ended and had to be reconnected.",
+	}, []string{"account"})
+
+	importDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "turbogmailify_import_duration_seconds",
+		Help: "Time taken to import a single message to Gmail.",
+	}, []string{"account"})
+
+	sessionDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "turbogmailify_session_duration_seconds",
+		Help: "Duration of a single IMAP session, from connection to disconnection.",
+	}, []string{"account"})
+
+	idleConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "turbogmailify_idle_connections",
+		Help: "Whether an account's IMAP connection is currently idling (1) or not (0).",
+	}, []string{"account"})
+
+	lastSuccessTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "turbogmailify_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last message an account successfully imported to Gmail.",
+	}, []string{"account"})
+)
+
+// Set once startup (config parsing and the initial Gmail OAuth flow) has
+// finished, for /readyz to report on.
+var ready atomic.Bool
+
+// Serve Prometheus metrics and health endpoints on addr in the background.
+// A no-op if addr is empty.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+// MIT License
+
+// Copyright (c) 2024 Ryan Young
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Run the OAuth authorization code flow via a loopback redirect: bind an
+// ephemeral local HTTP server, send the user to Google's consent screen with
+// that server as the redirect target, and wait for the resulting code on
+// the callback. This replaces the deprecated out-of-band flow, which
+// required the user to copy and paste a code into the terminal.
+func getTokenFromWeb(oauthCfg *oauth2.Config) *oauth2.Token {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal("unable to start OAuth callback listener", "err", err)
+	}
+
+	oauthCfg.RedirectURL = fmt.Sprintf(
+		"http://%s/", listener.Addr().(*net.TCPAddr).String())
+
+	state, err := randomState()
+	if err != nil {
+		fatal("unable to generate OAuth state", "err", err)
+	}
+
+	var (
+		codeCh = make(chan string, 1)
+		errCh  = make(chan error, 1)
+		mux    = http.NewServeMux()
+		srv    = &http.Server{Handler: mux}
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("state"); got != state {
+			fmt.Fprintln(w, "Authorization failed; you may close this tab.")
+			errCh <- fmt.Errorf("callback state %q does not match expected state", got)
+			return
+		}
+
+		if msg := r.URL.Query().Get("error"); msg != "" {
+			fmt.Fprintln(w, "Authorization failed; you may close this tab.")
+			errCh <- fmt.Errorf("authorization server returned error: %s", msg)
+			return
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			fmt.Fprintln(w, "Authorization failed; you may close this tab.")
+			errCh <- fmt.Errorf("callback is missing the code parameter")
+			return
+		}
+
+		fmt.Fprintln(w, "Authorization complete; you may close this tab.")
+		codeCh <- code
+	})
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	authURL := oauthCfg.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	slog.Info("open the following URL in a browser to authorize this application", "url", authURL)
+	openBrowser(authURL)
+
+	var code string
+	select {
+	case code = <-codeCh:
+	case err := <-errCh:
+		fatal("OAuth authorization failed", "err", err)
+	}
+
+	tok, err := oauthCfg.Exchange(context.Background(), code)
+	if err != nil {
+		fatal("unable to retrieve token from web", "err", err)
+	}
+	return tok
+}
+
+// Generate a random, URL-safe state value to bind an authorization request
+// to its callback, so the loopback server only accepts a code that came
+// from the consent screen it sent the user to.
+func randomState() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Best-effort attempt to open a URL in the user's default browser. Failures
+// are silently ignored since the URL is always also printed, which is the
+// only option on a headless machine.
+func openBrowser(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	_ = cmd.Start()
+}
+
+// Wraps an oauth2.TokenSource and invokes save whenever the underlying
+// source hands back a token that differs from the last one seen, so that
+// access tokens refreshed (and refresh tokens rotated) by the provider are
+// persisted instead of only living in memory.
+type savingTokenSource struct {
+	src  oauth2.TokenSource
+	save func(*oauth2.Token)
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil ||
+		tok.AccessToken != s.last.AccessToken ||
+		tok.RefreshToken != s.last.RefreshToken {
+
+		s.last = tok
+		s.save(tok)
+	}
+
+	return tok, nil
+}
@@ -0,0 +1,201 @@
+// MIT License
+
+// Copyright (c) 2024 Ryan Young
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// A scheduled Gmail search that prunes matching messages. Query is a Gmail
+// search string (e.g. "from:newsletters@x.com older_than:30d"); Action is
+// either "trash" or "archive".
+type gmailRule struct {
+	Query    string
+	Action   string
+	Interval jsonDuration
+}
+
+// A time.Duration that unmarshals from a Go duration string ("24h", "30m")
+// instead of a raw integer, so rule intervals read naturally in JSON.
+type jsonDuration time.Duration
+
+func (d jsonDuration) Duration() time.Duration { return time.Duration(d) }
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid rule interval %q: %w", s, err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("invalid rule interval %q: must be positive", s)
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// Resolve a list of Gmail label names to their IDs, creating any that don't
+// already exist. Returns a map keyed by label name.
+func ensureLabels(mail *gmail.Service, names []string) (map[string]string, error) {
+	ids := make(map[string]string, len(names))
+	if len(names) <= 0 {
+		return ids, nil
+	}
+
+	existing, err := mail.Users.Labels.List("me").Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Gmail labels: %w", err)
+	}
+
+	byName := make(map[string]string, len(existing.Labels))
+	for _, l := range existing.Labels {
+		byName[l.Name] = l.Id
+	}
+
+	for _, name := range names {
+		if id, ok := byName[name]; ok {
+			ids[name] = id
+			continue
+		}
+
+		created, err := mail.Users.Labels.Create("me", &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Gmail label %q: %w", name, err)
+		}
+		ids[name] = created.Id
+	}
+
+	return ids, nil
+}
+
+// Flatten a name->ID label map into a slice of IDs.
+func labelIDValues(ids map[string]string) []string {
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id)
+	}
+	return values
+}
+
+// Run a single pruning rule on a timer until the process exits.
+func runRule(mail *gmail.Service, account string, rule gmailRule) {
+	ticker := time.NewTicker(rule.Interval.Duration())
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		if err := applyRule(mail, rule); err != nil {
+			slog.Error("rule failed", "account", account, "query", rule.Query, "err", err)
+		}
+	}
+}
+
+// Run one Gmail search and trash or archive every matching message.
+func applyRule(mail *gmail.Service, rule gmailRule) error {
+	var ids []string
+
+	pageToken := ""
+	for {
+		call := mail.Users.Messages.List("me").Q(rule.Query)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Do()
+		if err != nil {
+			return fmt.Errorf("unable to search Gmail: %w", err)
+		}
+
+		for _, m := range resp.Messages {
+			ids = append(ids, m.Id)
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	if len(ids) <= 0 {
+		return nil
+	}
+
+	if rule.Action != "trash" && rule.Action != "archive" {
+		return fmt.Errorf("unknown rule action %q", rule.Action)
+	}
+
+	// Gmail rejects batch requests with more than 1000 ids, which a single
+	// broad rule (e.g. "prune everything older than 30d") can easily match.
+	for _, batch := range chunkIDs(ids, maxBatchIDs) {
+		switch rule.Action {
+		case "trash":
+			// BatchModify, not BatchDelete: the latter permanently deletes
+			// messages and bypasses Trash, which "trash" shouldn't do, and
+			// requires the full https://mail.google.com/ scope besides.
+			if err := mail.Users.Messages.BatchModify("me", &gmail.BatchModifyMessagesRequest{
+				Ids:            batch,
+				AddLabelIds:    []string{"TRASH"},
+				RemoveLabelIds: []string{"INBOX"},
+			}).Do(); err != nil {
+				return err
+			}
+		case "archive":
+			if err := mail.Users.Messages.BatchModify("me", &gmail.BatchModifyMessagesRequest{
+				Ids:            batch,
+				RemoveLabelIds: []string{"INBOX"},
+			}).Do(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Gmail's BatchModify endpoint rejects more than this many ids per request.
+const maxBatchIDs = 1000
+
+// Split ids into chunks of at most size elements each.
+func chunkIDs(ids []string, size int) [][]string {
+	var chunks [][]string
+	for size < len(ids) {
+		ids, chunks = ids[size:], append(chunks, ids[0:size:size])
+	}
+	return append(chunks, ids)
+}